@@ -1,17 +1,28 @@
 package mpawslambda
 
 import (
-	"errors"
+	"encoding/json"
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudwatch"
 	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
 	mp "github.com/mackerelio/go-mackerel-plugin-helper"
 )
 
@@ -21,6 +32,28 @@ const (
 	metricsTypeSum     = "Sum"
 	metricsTypeMaximum = "Maximum"
 	metricsTypeMinimum = "Minimum"
+
+	// defaultPeriod is the CloudWatch aggregation period, in seconds, used unless -period is given.
+	defaultPeriod = 300
+	// defaultDelay shifts the query window back to accommodate CloudWatch's publish latency.
+	defaultDelay = 60
+	// defaultCacheTTL governs how long discovery calls such as ListFunctions are cached.
+	defaultCacheTTL = 10 * time.Minute
+	// defaultRateLimit caps CloudWatch API calls per second unless -ratelimit is given.
+	// CloudWatch's default account limit is 50 TPS, and multiple plugin instances on the
+	// same host can easily exceed it once fanned out across many functions.
+	defaultRateLimit = 25
+
+	// maxMetricDataQueriesPerCall is CloudWatch's hard cap on MetricDataQuery entries in a
+	// single GetMetricData call; discovery across many functions routinely exceeds it.
+	maxMetricDataQueriesPerCall = 500
+
+	// maxRetries bounds how many times a throttled CloudWatch call is retried.
+	maxRetries = 5
+	// retryBaseDelay and retryMaxDelay bound the exponential part of the backoff applied
+	// between retries; random jitter of up to that same amount is added on top.
+	retryBaseDelay = 200 * time.Millisecond
+	retryMaxDelay  = 5 * time.Second
 )
 
 // has 1 CloudWatch MetricName and corresponding N Mackerel Metrics
@@ -34,6 +67,61 @@ type metric struct {
 	Type         string
 }
 
+// metricsGroups is the full set of Lambda CloudWatch metrics this plugin collects.
+var metricsGroups = [...]metricsGroup{
+	{CloudWatchName: "Invocations", Metrics: []metric{
+		{MackerelName: "TEMPORARY_invocations_total", Type: metricsTypeSum},
+	}},
+	{CloudWatchName: "Errors", Metrics: []metric{
+		{MackerelName: "invocations_error", Type: metricsTypeSum},
+	}},
+	{CloudWatchName: "Throttles", Metrics: []metric{
+		{MackerelName: "invocations_throttles", Type: metricsTypeSum},
+	}},
+	{CloudWatchName: "Duration", Metrics: []metric{
+		{MackerelName: "duration_avg", Type: metricsTypeAverage},
+		{MackerelName: "duration_max", Type: metricsTypeMaximum},
+		{MackerelName: "duration_min", Type: metricsTypeMinimum},
+	}},
+	{CloudWatchName: "ConcurrentExecutions", Metrics: []metric{
+		{MackerelName: "concurrent_executions_max", Type: metricsTypeMaximum},
+		{MackerelName: "concurrent_executions_avg", Type: metricsTypeAverage},
+	}},
+	{CloudWatchName: "UnreservedConcurrentExecutions", Metrics: []metric{
+		{MackerelName: "unreserved_concurrent_executions_max", Type: metricsTypeMaximum},
+	}},
+	{CloudWatchName: "IteratorAge", Metrics: []metric{
+		{MackerelName: "iterator_age_avg", Type: metricsTypeAverage},
+		{MackerelName: "iterator_age_max", Type: metricsTypeMaximum},
+	}},
+	{CloudWatchName: "DeadLetterErrors", Metrics: []metric{
+		{MackerelName: "dead_letter_errors", Type: metricsTypeSum},
+	}},
+	{CloudWatchName: "DestinationDeliveryFailures", Metrics: []metric{
+		{MackerelName: "destination_delivery_failures", Type: metricsTypeSum},
+	}},
+	{CloudWatchName: "ProvisionedConcurrentExecutions", Metrics: []metric{
+		{MackerelName: "provisioned_concurrent_executions_max", Type: metricsTypeMaximum},
+	}},
+	{CloudWatchName: "ProvisionedConcurrencyUtilization", Metrics: []metric{
+		{MackerelName: "provisioned_concurrency_utilization_max", Type: metricsTypeMaximum},
+	}},
+	{CloudWatchName: "ProvisionedConcurrencyInvocations", Metrics: []metric{
+		{MackerelName: "provisioned_concurrency_invocations", Type: metricsTypeSum},
+	}},
+	{CloudWatchName: "ProvisionedConcurrencySpilloverInvocations", Metrics: []metric{
+		{MackerelName: "provisioned_concurrency_spillover_invocations", Type: metricsTypeSum},
+	}},
+}
+
+// versionMetricsGroups is the subset of Lambda CloudWatch metrics broken out per
+// function version/alias when -dimension is configured.
+var versionMetricsGroups = [...]metricsGroup{
+	{CloudWatchName: "Invocations", Metrics: []metric{{MackerelName: "total", Type: metricsTypeSum}}},
+	{CloudWatchName: "Errors", Metrics: []metric{{MackerelName: "error", Type: metricsTypeSum}}},
+	{CloudWatchName: "Throttles", Metrics: []metric{{MackerelName: "throttles", Type: metricsTypeSum}}},
+}
+
 // LambdaPlugin mackerel plugin for aws Lambda
 type LambdaPlugin struct {
 	FunctionName string
@@ -41,9 +129,26 @@ type LambdaPlugin struct {
 
 	AccessKeyID     string
 	SecretAccessKey string
+	Token           string
 	Region          string
+	EndpointURL     string
+
+	RoleARN               string
+	ExternalID            string
+	Profile               string
+	SharedCredentialsFile string
+
+	Period     int64
+	Delay      int64
+	CacheTTL   time.Duration
+	Dimensions []string
+	RateLimit  int
 
 	CloudWatch *cloudwatch.CloudWatch
+	Lambda     *lambda.Lambda
+
+	rateLimiter *rateLimiter
+	retryPolicy func(func() error) error
 }
 
 // MetricKeyPrefix interface for PluginWithPrefix
@@ -51,73 +156,431 @@ func (p LambdaPlugin) MetricKeyPrefix() string {
 	return p.Prefix
 }
 
-// prepare creates CloudWatch instance
+// prepare creates CloudWatch and Lambda instances. Credentials are resolved, in order,
+// from a static access key pair, a role assumed via -role-arn, or otherwise the session's
+// own credentials: the -profile/-shared-credentials-file or the SDK's default chain
+// (environment, shared config, web identity token, EC2/ECS instance metadata). The
+// session's own credentials are also the ones used to assume -role-arn.
 func (p *LambdaPlugin) prepare() error {
+	sessOpts := session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+	}
+	if p.Profile != "" {
+		sessOpts.Profile = p.Profile
+	}
+	if p.SharedCredentialsFile != "" {
+		sessOpts.SharedConfigFiles = []string{p.SharedCredentialsFile}
+	}
 
-	sess, err := session.NewSession()
+	sess, err := session.NewSessionWithOptions(sessOpts)
 	if err != nil {
 		return err
 	}
 
 	config := aws.NewConfig()
-	if p.AccessKeyID != "" && p.SecretAccessKey != "" {
-		config = config.WithCredentials(credentials.NewStaticCredentials(p.AccessKeyID, p.SecretAccessKey, ""))
+	switch {
+	case p.AccessKeyID != "" && p.SecretAccessKey != "":
+		config = config.WithCredentials(credentials.NewStaticCredentials(p.AccessKeyID, p.SecretAccessKey, p.Token))
+	case p.RoleARN != "":
+		config = config.WithCredentials(stscreds.NewCredentials(sess, p.RoleARN, func(provider *stscreds.AssumeRoleProvider) {
+			provider.RoleSessionName = "mackerel-plugin-aws-lambda"
+			if p.ExternalID != "" {
+				provider.ExternalID = aws.String(p.ExternalID)
+			}
+		}))
 	}
 	if p.Region != "" {
 		config = config.WithRegion(p.Region)
 	}
+	if p.EndpointURL != "" {
+		config = config.WithEndpoint(p.EndpointURL)
+	}
 
 	p.CloudWatch = cloudwatch.New(sess, config)
+	p.Lambda = lambda.New(sess, config)
+
+	rateLimit := p.RateLimit
+	if rateLimit <= 0 {
+		rateLimit = defaultRateLimit
+	}
+	p.rateLimiter = newRateLimiter(rateLimit)
+	p.retryPolicy = withRetry
 
 	return nil
 }
 
-// getLastPoint fetches a CloudWatch metric and parse
-func getLastPointFromCloudWatch(cw cloudwatchiface.CloudWatchAPI, functionName string, metric metricsGroup) (*cloudwatch.Datapoint, error) {
-	now := time.Now()
-	statsInput := make([]*string, len(metric.Metrics))
-	for i, typ := range metric.Metrics {
-		statsInput[i] = aws.String(typ.Type)
-	}
-	response, err := cw.GetMetricStatistics(&cloudwatch.GetMetricStatisticsInput{
-		Dimensions: []*cloudwatch.Dimension{
-			{
-				Name:  aws.String("FunctionName"),
-				Value: aws.String(functionName),
-			},
-		},
-		StartTime:  aws.Time(now.Add(time.Duration(180) * time.Second * -1)), // 3 min
-		EndTime:    aws.Time(now),
-		MetricName: aws.String(metric.CloudWatchName),
-		Period:     aws.Int64(600),
-		Statistics: statsInput,
-		Namespace:  aws.String(namespace),
+// validatePeriod ensures period is a granularity CloudWatch actually supports:
+// 1, 5, 10, 30, or 60 seconds, or any multiple of 60 beyond that.
+func validatePeriod(period int64) error {
+	switch period {
+	case 1, 5, 10, 30, 60:
+		return nil
+	}
+	if period > 60 && period%60 == 0 {
+		return nil
+	}
+	return fmt.Errorf("invalid period %d: must be 1, 5, 10, 30, 60, or a multiple of 60", period)
+}
+
+var invalidMetricDataQueryIDChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// metricDataQueryID builds a CloudWatch GetMetricData query Id from a Mackerel metric name.
+// CloudWatch requires Ids to match ^[a-z][a-zA-Z0-9_]*$; the "m_" prefix already satisfies
+// the leading-lowercase-letter requirement, so the rest of the name is sanitized but not
+// lowercased -- lowercasing it would collide Ids for distinct, case-sensitive Lambda
+// function names (e.g. "FuncA" and "funca").
+func metricDataQueryID(mackerelName string) string {
+	return "m_" + invalidMetricDataQueryIDChars.ReplaceAllString(mackerelName, "_")
+}
+
+// buildMetricDataQueries assembles one MetricDataQuery per statistic so that every Lambda
+// metric for functionName can be fetched in a single GetMetricData call. The returned map
+// routes MetricDataResult.Id back to the Mackerel metric name it corresponds to.
+func buildMetricDataQueries(functionName string, period int64) ([]*cloudwatch.MetricDataQuery, map[string]string) {
+	var queries []*cloudwatch.MetricDataQuery
+	idToMackerelName := make(map[string]string)
+
+	for _, met := range metricsGroups {
+		for _, typ := range met.Metrics {
+			id := metricDataQueryID(typ.MackerelName)
+			idToMackerelName[id] = typ.MackerelName
+			queries = append(queries, &cloudwatch.MetricDataQuery{
+				Id: aws.String(id),
+				MetricStat: &cloudwatch.MetricStat{
+					Metric: &cloudwatch.Metric{
+						Namespace:  aws.String(namespace),
+						MetricName: aws.String(met.CloudWatchName),
+						Dimensions: []*cloudwatch.Dimension{
+							{
+								Name:  aws.String("FunctionName"),
+								Value: aws.String(functionName),
+							},
+						},
+					},
+					Period: aws.Int64(period),
+					Stat:   aws.String(typ.Type),
+				},
+			})
+		}
+	}
+
+	return queries, idToMackerelName
+}
+
+var invalidLabelChars = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// sanitizeLabel makes s safe to use as the wildcard segment of a Mackerel metric name.
+func sanitizeLabel(s string) string {
+	return invalidLabelChars.ReplaceAllString(s, "_")
+}
+
+// parseDimension parses a `-dimension Name=Value` flag into a CloudWatch dimension plus
+// a Mackerel-safe label derived from its value, used to name the wildcard metrics for
+// that version/alias. The label is the part of the value after the last ':', if any, so
+// "Resource=myFunction:prod" is labeled "prod" and "ExecutedVersion=3" is labeled "3".
+func parseDimension(s string) (*cloudwatch.Dimension, string, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, "", fmt.Errorf("invalid -dimension %q: expected Name=Value", s)
+	}
+	name, value := parts[0], parts[1]
+
+	label := value
+	if idx := strings.LastIndex(value, ":"); idx >= 0 {
+		label = value[idx+1:]
+	}
+	label = sanitizeLabel(label)
+
+	return &cloudwatch.Dimension{Name: aws.String(name), Value: aws.String(value)}, label, nil
+}
+
+// buildWildcardMetricDataQueries assembles one MetricDataQuery per versionMetricsGroups
+// statistic for the given CloudWatch dimensions, exposed as wildcard Mackerel metrics
+// such as invocations.<label>.total.
+func buildWildcardMetricDataQueries(period int64, dimensions []*cloudwatch.Dimension, label string) ([]*cloudwatch.MetricDataQuery, map[string]string) {
+	var queries []*cloudwatch.MetricDataQuery
+	idToMackerelName := make(map[string]string)
+
+	for _, met := range versionMetricsGroups {
+		for _, typ := range met.Metrics {
+			mackerelName := fmt.Sprintf("invocations.%s.%s", label, typ.MackerelName)
+			id := metricDataQueryID(label + "_" + typ.MackerelName)
+			idToMackerelName[id] = mackerelName
+			queries = append(queries, &cloudwatch.MetricDataQuery{
+				Id: aws.String(id),
+				MetricStat: &cloudwatch.MetricStat{
+					Metric: &cloudwatch.Metric{
+						Namespace:  aws.String(namespace),
+						MetricName: aws.String(met.CloudWatchName),
+						Dimensions: dimensions,
+					},
+					Period: aws.Int64(period),
+					Stat:   aws.String(typ.Type),
+				},
+			})
+		}
+	}
+
+	return queries, idToMackerelName
+}
+
+// buildVersionMetricDataQueries assembles MetricDataQuery entries for functionName plus
+// one extra CloudWatch dimension (e.g. Resource or ExecutedVersion), so a version or
+// alias can be graphed separately from the function's aggregate metrics.
+func buildVersionMetricDataQueries(functionName string, period int64, dim *cloudwatch.Dimension, label string) ([]*cloudwatch.MetricDataQuery, map[string]string) {
+	dimensions := []*cloudwatch.Dimension{
+		{Name: aws.String("FunctionName"), Value: aws.String(functionName)},
+		dim,
+	}
+	return buildWildcardMetricDataQueries(period, dimensions, label)
+}
+
+// buildFunctionMetricDataQueries assembles MetricDataQuery entries for one discovered
+// Lambda function, named with the function as the wildcard segment (e.g.
+// invocations.myFunction.total) so metrics for many functions can be told apart.
+//
+// This only covers versionMetricsGroups (invocation count/error/throttle), not the full
+// metricsGroups set: collecting Duration, concurrency, stream, and async delivery/
+// provisioned concurrency metrics per discovered function would mean a fresh graph per
+// function per account. Discovery mode (-function-name empty or a glob) is therefore
+// invocation-count only; the concurrency/stream/async_delivery/provisioned_concurrency
+// graphs are only populated when -function-name targets a single function.
+func buildFunctionMetricDataQueries(functionName string, period int64, label string) ([]*cloudwatch.MetricDataQuery, map[string]string) {
+	dimensions := []*cloudwatch.Dimension{
+		{Name: aws.String("FunctionName"), Value: aws.String(functionName)},
+	}
+	return buildWildcardMetricDataQueries(period, dimensions, label)
+}
+
+// isDiscoveryPattern reports whether functionName should trigger Lambda function
+// discovery via ListFunctions: either it is empty (match everything) or it contains
+// glob metacharacters.
+func isDiscoveryPattern(functionName string) bool {
+	return functionName == "" || strings.ContainsAny(functionName, "*?[")
+}
+
+type functionCache struct {
+	FetchedAt int64    `json:"fetched_at"`
+	Functions []string `json:"functions"`
+}
+
+// functionCachePath returns the cache file used to remember the full set of Lambda
+// function names between plugin invocations, scoped by metric key prefix, region, and
+// assumed role ARN. Region/role are part of the key, not just the prefix, so that two
+// plugin instances observing different AWS accounts (e.g. via -role-arn) never share a
+// cache file even if left at the same default -metric-key-prefix.
+func functionCachePath(prefix, region, roleARN string) string {
+	scope := prefix + "-" + region
+	if roleARN != "" {
+		scope += "-" + roleARN
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("mackerel-plugin-aws-lambda-functions-%s.json", sanitizeLabel(scope)))
+}
+
+func loadFunctionCache(path string, ttl time.Duration) ([]string, bool) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+
+	var cache functionCache
+	if err := json.Unmarshal(data, &cache); err != nil {
+		return nil, false
+	}
+	if time.Since(time.Unix(cache.FetchedAt, 0)) > ttl {
+		return nil, false
+	}
+
+	return cache.Functions, true
+}
+
+func saveFunctionCache(path string, functions []string) {
+	data, err := json.Marshal(functionCache{FetchedAt: time.Now().Unix(), Functions: functions})
+	if err != nil {
+		return
+	}
+	// Best-effort: a failure to cache just means the next run calls ListFunctions again.
+	_ = ioutil.WriteFile(path, data, 0600)
+}
+
+func matchFunctionNames(names []string, pattern string) []string {
+	if pattern == "" {
+		return names
+	}
+
+	var matched []string
+	for _, name := range names {
+		if ok, err := filepath.Match(pattern, name); err == nil && ok {
+			matched = append(matched, name)
+		}
+	}
+	return matched
+}
+
+// listFunctionNames returns the Lambda function names matching pattern (a glob, or ""
+// to match every function owned by the account), calling lambda:ListFunctions. The full
+// account function list is cached on disk for cacheTTL so repeated collection cycles
+// don't need to re-list on every run.
+func listFunctionNames(lambdaSvc lambdaiface.LambdaAPI, pattern string, cacheTTL time.Duration, cachePath string) ([]string, error) {
+	if names, ok := loadFunctionCache(cachePath, cacheTTL); ok {
+		return matchFunctionNames(names, pattern), nil
+	}
+
+	var names []string
+	err := lambdaSvc.ListFunctionsPages(&lambda.ListFunctionsInput{}, func(output *lambda.ListFunctionsOutput, lastPage bool) bool {
+		for _, fn := range output.Functions {
+			names = append(names, *fn.FunctionName)
+		}
+		return true
 	})
 	if err != nil {
 		return nil, err
 	}
 
-	datapoints := response.Datapoints
-	if len(datapoints) == 0 {
-		return nil, errors.New("fetched no datapoints")
+	saveFunctionCache(cachePath, names)
+
+	return matchFunctionNames(names, pattern), nil
+}
+
+// rateLimiter is a simple token-bucket limiter used to cap how often CloudWatch is
+// called, spacing out calls by 1/rate rather than allowing bursts.
+type rateLimiter struct {
+	interval time.Duration
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+// newRateLimiter returns a rateLimiter permitting at most ratePerSecond calls per second.
+func newRateLimiter(ratePerSecond int) *rateLimiter {
+	return &rateLimiter{interval: time.Second / time.Duration(ratePerSecond)}
+}
+
+// Wait blocks, if necessary, until the next call is allowed under the limiter's rate.
+func (r *rateLimiter) Wait() {
+	r.mu.Lock()
+	now := time.Now()
+	if r.next.Before(now) {
+		r.next = now
+	}
+	wait := r.next.Sub(now)
+	r.next = r.next.Add(r.interval)
+	r.mu.Unlock()
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// isThrottlingError reports whether err is a CloudWatch throttling response that is
+// worth retrying.
+func isThrottlingError(err error) bool {
+	awsErr, ok := err.(awserr.Error)
+	if !ok {
+		return false
+	}
+	switch awsErr.Code() {
+	case "Throttling", "ThrottlingException", "RequestLimitExceeded":
+		return true
+	}
+	return false
+}
+
+// withRetry calls fn, retrying with exponential backoff and jitter when it fails with a
+// CloudWatch throttling error, up to maxRetries times before giving up.
+func withRetry(fn func() error) error {
+	err := fn()
+	for attempt := 0; attempt < maxRetries && isThrottlingError(err); attempt++ {
+		delay := retryBaseDelay * time.Duration(1<<uint(attempt))
+		if delay > retryMaxDelay {
+			delay = retryMaxDelay
+		}
+		delay += time.Duration(rand.Int63n(int64(delay)))
+
+		time.Sleep(delay)
+		err = fn()
+	}
+	return err
+}
+
+// chunkMetricDataQueries splits queries into groups of at most size entries, since
+// CloudWatch rejects a GetMetricData call with more than maxMetricDataQueriesPerCall
+// MetricDataQueries.
+func chunkMetricDataQueries(queries []*cloudwatch.MetricDataQuery, size int) [][]*cloudwatch.MetricDataQuery {
+	var chunks [][]*cloudwatch.MetricDataQuery
+	for size < len(queries) {
+		chunks = append(chunks, queries[:size])
+		queries = queries[size:]
+	}
+	if len(queries) > 0 {
+		chunks = append(chunks, queries)
+	}
+	return chunks
+}
+
+// fetchMetricData fetches all queries, following CloudWatch's NextToken pagination, and
+// returns the latest value CloudWatch has for each query Id. limiter, if given, and retry
+// (withRetry when nil) are applied around every individual GetMetricData call -- including
+// each page of a paginated response -- so that rate limiting and retries can't be
+// bypassed by a query set large enough to span more than one page.
+func fetchMetricData(cw cloudwatchiface.CloudWatchAPI, queries []*cloudwatch.MetricDataQuery, period, delay int64, limiter *rateLimiter, retry func(func() error) error) (map[string]float64, error) {
+	if retry == nil {
+		retry = withRetry
 	}
 
-	latest := new(time.Time)
-	var latestDp *cloudwatch.Datapoint
-	for _, dp := range datapoints {
-		if dp.Timestamp.Before(*latest) {
-			continue
+	now := time.Now()
+	endTime := now.Add(time.Duration(delay) * time.Second * -1)
+	startTime := endTime.Add(time.Duration(period) * time.Second * -3)
+
+	values := make(map[string]float64)
+	var nextToken *string
+	for {
+		input := &cloudwatch.GetMetricDataInput{
+			StartTime:         aws.Time(startTime),
+			EndTime:           aws.Time(endTime),
+			MetricDataQueries: queries,
+			NextToken:         nextToken,
+		}
+
+		var output *cloudwatch.GetMetricDataOutput
+		err := retry(func() error {
+			if limiter != nil {
+				limiter.Wait()
+			}
+			out, err := cw.GetMetricData(input)
+			if err != nil {
+				return err
+			}
+			output = out
+			return nil
+		})
+		if err != nil {
+			return nil, err
 		}
 
-		latest = dp.Timestamp
-		latestDp = dp
+		for _, result := range output.MetricDataResults {
+			if len(result.Values) == 0 {
+				continue
+			}
+			// Values are newest first, and later pages carry older datapoints for the
+			// same Id, so the first value seen for an Id is the latest one.
+			if _, ok := values[*result.Id]; ok {
+				continue
+			}
+			values[*result.Id] = *result.Values[0]
+		}
+
+		if output.NextToken == nil {
+			break
+		}
+		nextToken = output.NextToken
 	}
 
-	return latestDp, nil
+	return values, nil
 }
 
-// TransformMetrics converts some of datapoints to post differences of two metrics
-func (p LambdaPlugin) TransformMetrics(stats map[string]interface{}) map[string]interface{} {
+// transformMetrics converts some of datapoints to post differences of two metrics
+func transformMetrics(stats map[string]interface{}) map[string]interface{} {
 	// Although stats are interface{}, those values from cloudwatch.Datapoint are guaranteed to be float64.
 	if totalCount, ok := stats["TEMPORARY_invocations_total"].(float64); ok {
 		if errorCount, ok := stats["invocations_error"].(float64); ok {
@@ -132,43 +595,64 @@ func (p LambdaPlugin) TransformMetrics(stats map[string]interface{}) map[string]
 
 // FetchMetrics fetch the metrics
 func (p LambdaPlugin) FetchMetrics() (map[string]interface{}, error) {
-	stat := make(map[string]interface{})
+	var queries []*cloudwatch.MetricDataQuery
+	idToMackerelName := make(map[string]string)
+
+	if isDiscoveryPattern(p.FunctionName) {
+		// Discovery mode only collects invocation count/error/throttle metrics per
+		// function (see buildFunctionMetricDataQueries); Duration and the other
+		// per-function graphs are only collected when -function-name targets a single
+		// function.
+		functionNames, err := listFunctionNames(p.Lambda, p.FunctionName, p.CacheTTL, functionCachePath(p.Prefix, p.Region, p.RoleARN))
+		if err != nil {
+			return nil, err
+		}
 
-	for _, met := range [...]metricsGroup{
-		{CloudWatchName: "Invocations", Metrics: []metric{
-			{MackerelName: "TEMPORARY_invocations_total", Type: metricsTypeSum},
-		}},
-		{CloudWatchName: "Errors", Metrics: []metric{
-			{MackerelName: "invocations_error", Type: metricsTypeSum},
-		}},
-		{CloudWatchName: "Throttles", Metrics: []metric{
-			{MackerelName: "invocations_throttles", Type: metricsTypeSum},
-		}},
-		{CloudWatchName: "Duration", Metrics: []metric{
-			{MackerelName: "duration_avg", Type: metricsTypeAverage},
-			{MackerelName: "duration_max", Type: metricsTypeMaximum},
-			{MackerelName: "duration_min", Type: metricsTypeMinimum},
-		}},
-	} {
-		v, err := getLastPointFromCloudWatch(p.CloudWatch, p.FunctionName, met)
-		if err == nil {
-			for _, typ := range met.Metrics {
-				switch typ.Type {
-				case metricsTypeAverage:
-					stat[typ.MackerelName] = *v.Average
-				case metricsTypeSum:
-					stat[typ.MackerelName] = *v.Sum
-				case metricsTypeMaximum:
-					stat[typ.MackerelName] = *v.Maximum
-				case metricsTypeMinimum:
-					stat[typ.MackerelName] = *v.Minimum
-				}
+		for _, functionName := range functionNames {
+			fnQueries, fnIDToMackerelName := buildFunctionMetricDataQueries(functionName, p.Period, sanitizeLabel(functionName))
+			queries = append(queries, fnQueries...)
+			for id, name := range fnIDToMackerelName {
+				idToMackerelName[id] = name
 			}
-		} else {
-			log.Printf("%s: %s", met, err)
 		}
+	} else {
+		baseQueries, baseIDToMackerelName := buildMetricDataQueries(p.FunctionName, p.Period)
+		queries = append(queries, baseQueries...)
+		for id, name := range baseIDToMackerelName {
+			idToMackerelName[id] = name
+		}
+
+		for _, rawDimension := range p.Dimensions {
+			dim, label, err := parseDimension(rawDimension)
+			if err != nil {
+				log.Printf("%s", err)
+				continue
+			}
+			verQueries, verIDToMackerelName := buildVersionMetricDataQueries(p.FunctionName, p.Period, dim, label)
+			queries = append(queries, verQueries...)
+			for id, name := range verIDToMackerelName {
+				idToMackerelName[id] = name
+			}
+		}
+	}
+
+	values := make(map[string]float64)
+	for _, chunk := range chunkMetricDataQueries(queries, maxMetricDataQueriesPerCall) {
+		v, err := fetchMetricData(p.CloudWatch, chunk, p.Period, p.Delay, p.rateLimiter, p.retryPolicy)
+		if err != nil {
+			return nil, err
+		}
+		for id, val := range v {
+			values[id] = val
+		}
+	}
+
+	stat := make(map[string]interface{})
+	for id, v := range values {
+		stat[idToMackerelName[id]] = v
 	}
-	return p.TransformMetrics(stat), nil
+
+	return transformMetrics(stat), nil
 }
 
 // GraphDefinition of LambdaPlugin
@@ -194,28 +678,111 @@ func (p LambdaPlugin) GraphDefinition() map[string]mp.Graphs {
 				{Name: "duration_min", Label: "Minimum"},
 			},
 		},
+		"invocations_by_version": {
+			Label: (labelPrefix + " Invocations By Version"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "invocations.#.total", Label: "%1 Total"},
+				{Name: "invocations.#.error", Label: "%1 Error"},
+				{Name: "invocations.#.throttles", Label: "%1 Throttles"},
+			},
+		},
+		"concurrency": {
+			Label: (labelPrefix + " Concurrency"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "concurrent_executions_max", Label: "Concurrent Executions (Max)"},
+				{Name: "concurrent_executions_avg", Label: "Concurrent Executions (Average)"},
+				{Name: "unreserved_concurrent_executions_max", Label: "Unreserved Concurrent Executions (Max)"},
+			},
+		},
+		"stream": {
+			Label: (labelPrefix + " Stream"),
+			Unit:  "float",
+			Metrics: []mp.Metrics{
+				{Name: "iterator_age_avg", Label: "Iterator Age (Average)"},
+				{Name: "iterator_age_max", Label: "Iterator Age (Max)"},
+			},
+		},
+		"async_delivery": {
+			Label: (labelPrefix + " Async Delivery"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "dead_letter_errors", Label: "Dead Letter Errors"},
+				{Name: "destination_delivery_failures", Label: "Destination Delivery Failures"},
+			},
+		},
+		"provisioned_concurrency": {
+			Label: (labelPrefix + " Provisioned Concurrency"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "provisioned_concurrent_executions_max", Label: "Provisioned Concurrent Executions (Max)"},
+				{Name: "provisioned_concurrency_utilization_max", Label: "Provisioned Concurrency Utilization (Max)"},
+				{Name: "provisioned_concurrency_invocations", Label: "Provisioned Concurrency Invocations"},
+				{Name: "provisioned_concurrency_spillover_invocations", Label: "Provisioned Concurrency Spillover Invocations"},
+			},
+		},
 	}
 	return graphdef
 }
 
+// dimensionsFlag collects repeated -dimension flag occurrences.
+type dimensionsFlag []string
+
+func (d *dimensionsFlag) String() string {
+	return strings.Join(*d, ",")
+}
+
+func (d *dimensionsFlag) Set(value string) error {
+	*d = append(*d, value)
+	return nil
+}
+
 // Do the plugin
 func Do() {
 	optAccessKeyID := flag.String("access-key-id", "", "AWS Access Key ID")
 	optSecretAccessKey := flag.String("secret-access-key", "", "AWS Secret Access Key")
+	optToken := flag.String("token", "", "AWS session token, used together with -access-key-id/-secret-access-key")
 	optRegion := flag.String("region", "", "AWS Region")
-	optFunctionName := flag.String("function-name", "", "Function Name")
+	optEndpointURL := flag.String("endpoint-url", "", "Override the CloudWatch/Lambda API endpoint URL")
+	optRoleARN := flag.String("role-arn", "", "IAM role ARN to assume via STS before making AWS API calls")
+	optExternalID := flag.String("external-id", "", "External ID to use when assuming -role-arn")
+	optProfile := flag.String("profile", "", "AWS shared config/credentials profile to use")
+	optSharedCredentialsFile := flag.String("shared-credentials-file", "", "Path to an AWS shared credentials file")
+	optFunctionName := flag.String("function-name", "", "Function Name, a glob pattern (e.g. \"my-app-*\"), or empty to discover every function via ListFunctions (discovery mode only collects invocation count/error/throttle metrics, not Duration or the other per-function graphs)")
 	optTempfile := flag.String("tempfile", "", "Temp file name")
 	optPrefix := flag.String("metric-key-prefix", "lambda", "Metric key prefix")
+	optPeriod := flag.Int64("period", defaultPeriod, "CloudWatch metrics period in seconds (1/5/10/30/60 or a multiple of 60)")
+	optDelay := flag.Int64("delay", defaultDelay, "Seconds to shift the query window back to accommodate CloudWatch publish latency")
+	optCacheTTL := flag.Duration("cache-ttl", defaultCacheTTL, "How long to cache the Lambda function list fetched via ListFunctions in discovery mode")
+	optRateLimit := flag.Int("ratelimit", defaultRateLimit, "Maximum CloudWatch API calls per second")
+	var optDimensions dimensionsFlag
+	flag.Var(&optDimensions, "dimension", "Additional CloudWatch dimension as Name=Value (e.g. Resource=myFunction:prod), repeatable")
 	flag.Parse()
 
+	if err := validatePeriod(*optPeriod); err != nil {
+		log.Fatalln(err)
+	}
+
 	var plugin LambdaPlugin
 
 	plugin.AccessKeyID = *optAccessKeyID
 	plugin.SecretAccessKey = *optSecretAccessKey
+	plugin.Token = *optToken
 	plugin.Region = *optRegion
+	plugin.EndpointURL = *optEndpointURL
+	plugin.RoleARN = *optRoleARN
+	plugin.ExternalID = *optExternalID
+	plugin.Profile = *optProfile
+	plugin.SharedCredentialsFile = *optSharedCredentialsFile
 
 	plugin.FunctionName = *optFunctionName
 	plugin.Prefix = *optPrefix
+	plugin.Period = *optPeriod
+	plugin.Delay = *optDelay
+	plugin.CacheTTL = *optCacheTTL
+	plugin.Dimensions = optDimensions
+	plugin.RateLimit = *optRateLimit
 
 	err := plugin.prepare()
 	if err != nil {
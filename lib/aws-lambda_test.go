@@ -2,12 +2,16 @@ package mpawslambda
 
 import (
 	"errors"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/cloudwatch"
 	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
 	mp "github.com/mackerelio/go-mackerel-plugin-helper"
 	"github.com/stretchr/testify/assert"
 )
@@ -20,8 +24,8 @@ func defaultLambda() LambdaPlugin {
 
 func TestGraphDefinition(t *testing.T) {
 	graphdef := defaultLambda().GraphDefinition()
-	if len(graphdef) != 2 {
-		t.Errorf("GraphDefinition: %d should be 2", len(graphdef))
+	if len(graphdef) != 7 {
+		t.Errorf("GraphDefinition: %d should be 7", len(graphdef))
 	}
 }
 
@@ -31,7 +35,7 @@ func ExampleGraphDefinition() {
 
 	// Output:
 	// # mackerel-agent-plugin
-	// {"graphs":{"lambda.duration":{"label":"Lambda Duration","unit":"float","metrics":[{"name":"duration_avg","label":"Average","stacked":false},{"name":"duration_max","label":"Maximum","stacked":false},{"name":"duration_min","label":"Minimum","stacked":false}]},"lambda.invocations":{"label":"Lambda Invocations","unit":"integer","metrics":[{"name":"invocations_success","label":"Success","stacked":true},{"name":"invocations_error","label":"Error","stacked":true},{"name":"invocations_throttles","label":"Throttles","stacked":true}]}}}
+	// {"graphs":{"lambda.async_delivery":{"label":"Lambda Async Delivery","unit":"integer","metrics":[{"name":"dead_letter_errors","label":"Dead Letter Errors","stacked":false},{"name":"destination_delivery_failures","label":"Destination Delivery Failures","stacked":false}]},"lambda.concurrency":{"label":"Lambda Concurrency","unit":"integer","metrics":[{"name":"concurrent_executions_max","label":"Concurrent Executions (Max)","stacked":false},{"name":"concurrent_executions_avg","label":"Concurrent Executions (Average)","stacked":false},{"name":"unreserved_concurrent_executions_max","label":"Unreserved Concurrent Executions (Max)","stacked":false}]},"lambda.duration":{"label":"Lambda Duration","unit":"float","metrics":[{"name":"duration_avg","label":"Average","stacked":false},{"name":"duration_max","label":"Maximum","stacked":false},{"name":"duration_min","label":"Minimum","stacked":false}]},"lambda.invocations":{"label":"Lambda Invocations","unit":"integer","metrics":[{"name":"invocations_success","label":"Success","stacked":true},{"name":"invocations_error","label":"Error","stacked":true},{"name":"invocations_throttles","label":"Throttles","stacked":true}]},"lambda.invocations_by_version":{"label":"Lambda Invocations By Version","unit":"integer","metrics":[{"name":"invocations.#.total","label":"%1 Total","stacked":false},{"name":"invocations.#.error","label":"%1 Error","stacked":false},{"name":"invocations.#.throttles","label":"%1 Throttles","stacked":false}]},"lambda.provisioned_concurrency":{"label":"Lambda Provisioned Concurrency","unit":"integer","metrics":[{"name":"provisioned_concurrent_executions_max","label":"Provisioned Concurrent Executions (Max)","stacked":false},{"name":"provisioned_concurrency_utilization_max","label":"Provisioned Concurrency Utilization (Max)","stacked":false},{"name":"provisioned_concurrency_invocations","label":"Provisioned Concurrency Invocations","stacked":false},{"name":"provisioned_concurrency_spillover_invocations","label":"Provisioned Concurrency Spillover Invocations","stacked":false}]},"lambda.stream":{"label":"Lambda Stream","unit":"float","metrics":[{"name":"iterator_age_avg","label":"Iterator Age (Average)","stacked":false},{"name":"iterator_age_max","label":"Iterator Age (Max)","stacked":false}]}}}
 }
 
 func TestPrepare(t *testing.T) {
@@ -43,6 +47,19 @@ func TestPrepare(t *testing.T) {
 	// XXX Maybe we should test around AccesKeyID?
 }
 
+func TestPrepareWithRoleARN(t *testing.T) {
+	p := defaultLambda()
+	p.Region = "MySuperRegion"
+	p.RoleARN = "arn:aws:iam::123456789012:role/test-role"
+	p.ExternalID = "ext-id"
+
+	err := p.prepare()
+	if err != nil {
+		t.Errorf("prepare fails: %s", err)
+	}
+	assert.NotNil(t, p.CloudWatch.Config.Credentials, "credentials for the assumed role are wired in")
+}
+
 func TestTransformMetrics(t *testing.T) {
 	regularStats := map[string]interface{}{
 		"TEMPORARY_invocations_total": 150.0,
@@ -85,130 +102,288 @@ func TestTransformMetrics(t *testing.T) {
 type mockCloudWatchClient struct {
 	cloudwatchiface.CloudWatchAPI
 	RequestedCount int
+	// FailTimes, if set, makes the first FailTimes calls return a Throttling error.
+	FailTimes int
 }
 
-func (m *mockCloudWatchClient) GetMetricStatistics(input *cloudwatch.GetMetricStatisticsInput) (*cloudwatch.GetMetricStatisticsOutput, error) {
+func (m *mockCloudWatchClient) GetMetricData(input *cloudwatch.GetMetricDataInput) (*cloudwatch.GetMetricDataOutput, error) {
 	m.RequestedCount++
-	// Returns error unless expected payload
+	if m.RequestedCount <= m.FailTimes {
+		return nil, throttlingError{}
+	}
 
-	// Check `Dimensions`
-	expectedDimensions := []*cloudwatch.Dimension{
-		{
-			Name:  aws.String("FunctionName"),
-			Value: aws.String("myFunction"),
-		},
+	now := time.Now()
+	output := new(cloudwatch.GetMetricDataOutput)
+	for _, q := range input.MetricDataQueries {
+		var value float64
+		switch *q.MetricStat.Stat {
+		case metricsTypeAverage:
+			value = 25.0
+		case metricsTypeMaximum:
+			value = 45.0
+		case metricsTypeMinimum:
+			value = 5.0
+		default:
+			value = 30.0
+		}
+		output.MetricDataResults = append(output.MetricDataResults, &cloudwatch.MetricDataResult{
+			Id:         q.Id,
+			Timestamps: []*time.Time{aws.Time(now)},
+			Values:     []*float64{aws.Float64(value)},
+		})
 	}
-	if !assert.ObjectsAreEqual(expectedDimensions, input.Dimensions) {
-		return nil, errors.New("Unexpected Dimension")
+
+	return output, nil
+}
+
+func TestValidatePeriod(t *testing.T) {
+	for _, period := range []int64{1, 5, 10, 30, 60, 120, 600} {
+		assert.NoError(t, validatePeriod(period), "%d should be a valid period", period)
 	}
 
-	// Check `Statistics` for given `MetricName`
-	var expectedStatistics []*string
-	switch *input.MetricName {
-	case "Duration":
-		expectedStatistics = []*string{aws.String("Average"), aws.String("Maximum"), aws.String("Minimum")}
-	default:
-		expectedStatistics = []*string{aws.String("Sum")}
+	for _, period := range []int64{0, 2, 45, 90, 301} {
+		assert.Error(t, validatePeriod(period), "%d should be an invalid period", period)
 	}
-	if !assert.ObjectsAreEqual(expectedStatistics, input.Statistics) {
-		return nil, errors.New("Wrong Statistics")
+}
+
+func TestBuildMetricDataQueries(t *testing.T) {
+	queries, idToMackerelName := buildMetricDataQueries("myFunction", 300)
+
+	assert.Equal(t, 17, len(queries), "one query per statistic across all metric groups")
+	assert.Equal(t, 17, len(idToMackerelName))
+
+	for _, q := range queries {
+		assert.Equal(t, "myFunction", *q.MetricStat.Metric.Dimensions[0].Value)
+		assert.Equal(t, int64(300), *q.MetricStat.Period)
+		assert.Contains(t, idToMackerelName, *q.Id, "query Id must be routable back to a Mackerel metric name")
 	}
+}
 
-	// Construct Mock Response
-	now := time.Now()
-	output := new(cloudwatch.GetMetricStatisticsOutput)
-	output.Label = input.MetricName
-	switch *output.Label {
-	case "Duration":
-		output.Datapoints = []*cloudwatch.Datapoint{
-			{Average: aws.Float64(30.0), Maximum: aws.Float64(50.0), Minimum: aws.Float64(10.0), Timestamp: aws.Time(now)},
-			{Average: aws.Float64(25.0), Maximum: aws.Float64(45.0), Minimum: aws.Float64(5.0), Timestamp: aws.Time(now.Add(time.Duration(60) * time.Second * +1))},
-			{Average: aws.Float64(35.0), Maximum: aws.Float64(55.0), Minimum: aws.Float64(15.0), Timestamp: aws.Time(now.Add(time.Duration(60) * time.Second * -1))},
-		}
-	default:
-		output.Datapoints = []*cloudwatch.Datapoint{
-			{Sum: aws.Float64(30.0), Timestamp: aws.Time(now)},
-			{Sum: aws.Float64(25.0), Timestamp: aws.Time(now.Add(time.Duration(60) * time.Second * +1))},
-			{Sum: aws.Float64(35.0), Timestamp: aws.Time(now.Add(time.Duration(60) * time.Second * -1))},
+func TestFetchMetricData(t *testing.T) {
+	mockCw := &mockCloudWatchClient{}
+
+	queries, idToMackerelName := buildMetricDataQueries("myFunction", 300)
+	values, err := fetchMetricData(mockCw, queries, 300, 60, nil, nil)
+	if err != nil {
+		t.Errorf("fetchMetricData fails: %s", err)
+		return
+	}
+
+	assert.Equal(t, 1, mockCw.RequestedCount, "all metrics are fetched in a single GetMetricData call")
+	assert.Equal(t, 17, len(values))
+
+	for id, name := range idToMackerelName {
+		if name == "duration_avg" {
+			assert.Equal(t, 25.0, values[id])
 		}
 	}
-	return output, nil
 }
 
-func TestGetLastPointFromCloudWatch(t *testing.T) {
-	mockCw := &mockCloudWatchClient{}
+func TestFetchMetricDataRetriesEachCall(t *testing.T) {
+	mockCw := &mockCloudWatchClient{FailTimes: 2}
 
-	dp0, err := getLastPointFromCloudWatch(mockCw, "myFunction",
-		metricsGroup{CloudWatchName: "Throttles", Metrics: []metric{
-			{MackerelName: "invocations_throttles", Type: metricsTypeSum},
-		}})
+	queries, _ := buildMetricDataQueries("myFunction", 300)
+	_, err := fetchMetricData(mockCw, queries, 300, 60, nil, withRetry)
 	if err != nil {
-		t.Errorf("getLastPointFromCloudWatch fails: %s", err)
+		t.Errorf("fetchMetricData fails: %s", err)
+		return
+	}
+
+	assert.Equal(t, 3, mockCw.RequestedCount, "the retry policy wraps the individual GetMetricData call, not just the outer fetch")
+}
+
+func TestChunkMetricDataQueries(t *testing.T) {
+	queries, _ := buildMetricDataQueries("myFunction", 300)
+
+	chunks := chunkMetricDataQueries(queries, 5)
+	assert.Equal(t, 4, len(chunks), "17 queries in chunks of 5 is 4 chunks")
+
+	var total int
+	for i, chunk := range chunks {
+		if i < len(chunks)-1 {
+			assert.Equal(t, 5, len(chunk))
+		}
+		total += len(chunk)
+	}
+	assert.Equal(t, len(queries), total, "no query is dropped or duplicated")
+
+	assert.Empty(t, chunkMetricDataQueries(nil, 500))
+}
+
+func TestParseDimension(t *testing.T) {
+	dim, label, err := parseDimension("Resource=myFunction:prod")
+	if err != nil {
+		t.Errorf("parseDimension fails: %s", err)
 	} else {
-		assert.Equal(t,
-			&cloudwatch.Datapoint{Sum: aws.Float64(25.0), Timestamp: dp0.Timestamp},
-			dp0,
-			"Can request Single statistics")
-	}
-
-	dp1, err := getLastPointFromCloudWatch(mockCw, "myFunction",
-		metricsGroup{CloudWatchName: "Duration", Metrics: []metric{
-			{MackerelName: "duration_avg", Type: metricsTypeAverage},
-			{MackerelName: "duration_max", Type: metricsTypeMaximum},
-			{MackerelName: "duration_min", Type: metricsTypeMinimum},
-		}})
+		assert.Equal(t, "Resource", *dim.Name)
+		assert.Equal(t, "myFunction:prod", *dim.Value)
+		assert.Equal(t, "prod", label)
+	}
+
+	dim, label, err = parseDimension("ExecutedVersion=3")
 	if err != nil {
-		t.Errorf("getLastPointFromCloudWatch fails: %s", err)
+		t.Errorf("parseDimension fails: %s", err)
 	} else {
-		assert.Equal(t,
-			&cloudwatch.Datapoint{Average: aws.Float64(25.0), Maximum: aws.Float64(45.0), Minimum: aws.Float64(5.0), Timestamp: dp1.Timestamp},
-			dp1,
-			"Can request multiple statistics at once")
+		assert.Equal(t, "ExecutedVersion", *dim.Name)
+		assert.Equal(t, "3", *dim.Value)
+		assert.Equal(t, "3", label)
 	}
 
-	assert.Equal(t, 2, mockCw.RequestedCount, "CloudWatch request is done just twice")
+	_, _, err = parseDimension("invalid")
+	assert.Error(t, err, "Name=Value is required")
 }
 
-func TestMergeStatsFromDatapoint(t *testing.T) {
-	stats := make(map[string]interface{})
-	dp := cloudwatch.Datapoint{
-		Average:   aws.Float64(25.0),
-		Maximum:   aws.Float64(45.0),
-		Minimum:   aws.Float64(5.0),
-		Sum:       aws.Float64(500.0),
-		Timestamp: aws.Time(time.Now()),
+func TestBuildVersionMetricDataQueries(t *testing.T) {
+	dim := &cloudwatch.Dimension{Name: aws.String("Resource"), Value: aws.String("myFunction:prod")}
+	queries, idToMackerelName := buildVersionMetricDataQueries("myFunction", 300, dim, "prod")
+
+	assert.Equal(t, 3, len(queries), "one query per statistic in versionMetricsGroups")
+
+	for _, q := range queries {
+		assert.Equal(t, 2, len(q.MetricStat.Metric.Dimensions), "FunctionName plus the extra dimension")
+		assert.Equal(t, "myFunction:prod", *q.MetricStat.Metric.Dimensions[1].Value, "the real dimension value is sent to CloudWatch, not the display label")
 	}
 
-	stats = mergeStatsFromDatapoint(stats,
-		&dp,
-		metricsGroup{CloudWatchName: "Invocations", Metrics: []metric{
-			{MackerelName: "TEMPORARY_invocations_total", Type: metricsTypeSum},
-		}})
+	assert.Contains(t, idToMackerelName, metricDataQueryID("prod_total"))
+	assert.Equal(t, "invocations.prod.total", idToMackerelName[metricDataQueryID("prod_total")])
+}
 
-	assert.Equal(t,
-		map[string]interface{}{
-			"TEMPORARY_invocations_total": 500.0,
-		},
-		stats,
-		"Can merge single stat",
-	)
-
-	stats = mergeStatsFromDatapoint(stats,
-		&dp,
-		metricsGroup{CloudWatchName: "Duration", Metrics: []metric{
-			{MackerelName: "duration_avg", Type: metricsTypeAverage},
-			{MackerelName: "duration_max", Type: metricsTypeMaximum},
-			{MackerelName: "duration_min", Type: metricsTypeMinimum},
-		}})
+func TestIsDiscoveryPattern(t *testing.T) {
+	assert.True(t, isDiscoveryPattern(""), "empty function name discovers everything")
+	assert.True(t, isDiscoveryPattern("my-app-*"))
+	assert.True(t, isDiscoveryPattern("my-app-[0-9]"))
+	assert.False(t, isDiscoveryPattern("myFunction"))
+}
 
-	assert.Equal(t,
-		map[string]interface{}{
-			"TEMPORARY_invocations_total": 500.0,
-			"duration_avg":                25.0,
-			"duration_max":                45.0,
-			"duration_min":                5.0,
-		},
-		stats,
-		"Can merge already existing stats / can merge multiple stats at once",
-	)
+func TestBuildFunctionMetricDataQueries(t *testing.T) {
+	queries, idToMackerelName := buildFunctionMetricDataQueries("myFunction", 300, "myFunction")
+
+	assert.Equal(t, 3, len(queries))
+	for _, q := range queries {
+		assert.Equal(t, 1, len(q.MetricStat.Metric.Dimensions))
+		assert.Equal(t, "myFunction", *q.MetricStat.Metric.Dimensions[0].Value)
+	}
+
+	assert.Equal(t, "invocations.myFunction.total", idToMackerelName[metricDataQueryID("myFunction_total")])
+}
+
+func TestMetricDataQueryIDPreservesCase(t *testing.T) {
+	assert.NotEqual(t, metricDataQueryID("FuncA_total"), metricDataQueryID("funca_total"),
+		"distinct, case-sensitive function names must not collide on the same query Id")
+}
+
+type mockLambdaClient struct {
+	lambdaiface.LambdaAPI
+	RequestedCount int
+	FunctionNames  []string
+}
+
+func (m *mockLambdaClient) ListFunctionsPages(input *lambda.ListFunctionsInput, fn func(*lambda.ListFunctionsOutput, bool) bool) error {
+	m.RequestedCount++
+
+	output := new(lambda.ListFunctionsOutput)
+	for _, name := range m.FunctionNames {
+		output.Functions = append(output.Functions, &lambda.FunctionConfiguration{FunctionName: aws.String(name)})
+	}
+
+	fn(output, true)
+	return nil
+}
+
+func TestFunctionCachePath(t *testing.T) {
+	assert.NotEqual(t,
+		functionCachePath("lambda", "us-east-1", "arn:aws:iam::111111111111:role/monitoring"),
+		functionCachePath("lambda", "us-east-1", "arn:aws:iam::222222222222:role/monitoring"),
+		"different assumed roles (different accounts) must not share a cache file")
+
+	assert.NotEqual(t,
+		functionCachePath("lambda", "us-east-1", ""),
+		functionCachePath("lambda", "us-west-2", ""),
+		"different regions must not share a cache file")
+}
+
+func TestListFunctionNames(t *testing.T) {
+	mockLambda := &mockLambdaClient{FunctionNames: []string{"myApp-foo", "myApp-bar", "other"}}
+	cachePath := filepath.Join(t.TempDir(), "functions.json")
+
+	names, err := listFunctionNames(mockLambda, "myApp-*", time.Minute, cachePath)
+	if err != nil {
+		t.Errorf("listFunctionNames fails: %s", err)
+	}
+	assert.ElementsMatch(t, []string{"myApp-foo", "myApp-bar"}, names)
+	assert.Equal(t, 1, mockLambda.RequestedCount)
+
+	// A second call within cacheTTL must be served from the cache file, not ListFunctions again.
+	names, err = listFunctionNames(mockLambda, "", time.Minute, cachePath)
+	if err != nil {
+		t.Errorf("listFunctionNames fails: %s", err)
+	}
+	assert.ElementsMatch(t, []string{"myApp-foo", "myApp-bar", "other"}, names)
+	assert.Equal(t, 1, mockLambda.RequestedCount, "cached result is reused")
+
+	// Once the cache has expired, ListFunctions is called again.
+	names, err = listFunctionNames(mockLambda, "", 0, cachePath)
+	if err != nil {
+		t.Errorf("listFunctionNames fails: %s", err)
+	}
+	assert.ElementsMatch(t, []string{"myApp-foo", "myApp-bar", "other"}, names)
+	assert.Equal(t, 2, mockLambda.RequestedCount, "expired cache triggers a fresh ListFunctions call")
+}
+
+func TestPrepareSetsRateLimiterAndRetryPolicy(t *testing.T) {
+	p := defaultLambda()
+	p.RateLimit = 10
+
+	err := p.prepare()
+	if err != nil {
+		t.Errorf("prepare fails: %s", err)
+	}
+	assert.NotNil(t, p.rateLimiter, "a rate limiter is wired in")
+	assert.Equal(t, time.Second/10, p.rateLimiter.interval)
+	assert.NotNil(t, p.retryPolicy, "a retry policy is wired in")
+}
+
+func TestNewRateLimiter(t *testing.T) {
+	assert.Equal(t, time.Second/defaultRateLimit, newRateLimiter(defaultRateLimit).interval)
+}
+
+type throttlingError struct{}
+
+func (throttlingError) Error() string   { return "throttled" }
+func (throttlingError) Code() string    { return "Throttling" }
+func (throttlingError) Message() string { return "Rate exceeded" }
+func (throttlingError) OrigErr() error  { return nil }
+
+var _ awserr.Error = throttlingError{}
+
+func TestIsThrottlingError(t *testing.T) {
+	assert.True(t, isThrottlingError(throttlingError{}))
+	assert.False(t, isThrottlingError(errors.New("boom")), "non-AWS errors are not retried")
+	assert.False(t, isThrottlingError(awserr.New("AccessDenied", "nope", nil)), "non-throttling AWS errors are not retried")
+}
+
+func TestWithRetrySucceedsAfterThrottling(t *testing.T) {
+	attempts := 0
+	err := withRetry(func() error {
+		attempts++
+		if attempts < 3 {
+			return throttlingError{}
+		}
+		return nil
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, 3, attempts, "retries until the call succeeds")
+}
+
+func TestWithRetryGivesUpOnNonThrottlingError(t *testing.T) {
+	attempts := 0
+	boom := errors.New("boom")
+	err := withRetry(func() error {
+		attempts++
+		return boom
+	})
+
+	assert.Equal(t, boom, err)
+	assert.Equal(t, 1, attempts, "non-throttling errors are not retried")
 }
\ No newline at end of file